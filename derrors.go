@@ -5,7 +5,10 @@ package derrors
 import (
 	"errors"
 	"fmt"
+	"log/slog"
+	"net/http"
 	"runtime"
+	"strings"
 )
 
 // Wrap adds context to the error and allows
@@ -33,21 +36,48 @@ func WrapStack(errp *error, format string, args ...interface{}) {
 	}
 }
 
-// StackError wraps an error and adds a stack trace.
+// MaxStackDepth is the maximum number of stack frames captured by
+// NewStackError. Lower it to reduce the cost of capturing a stack trace
+// in hot paths.
+var MaxStackDepth = 32
+
+// StackError wraps an error and adds a stack trace, captured as a slice
+// of program counters rather than a pre-rendered trace so that
+// symbolication (looking up file/line/function for each frame) is only
+// paid for if the stack is actually printed or inspected.
 type StackError struct {
-	Stack []byte
-	err   error
+	pcs []uintptr
+	err error
+}
+
+// StackFrame describes a single symbolicated frame of a StackError's
+// captured stack trace.
+type StackFrame struct {
+	Function string
+	File     string
+	Line     int
 }
 
-// NewStackError returns a StackError, capturing a stack trace.
+// NewStackError returns a StackError wrapping err, capturing a stack
+// trace at the call site. If err's chain already carries a StackError,
+// NewStackError reuses its captured trace instead of capturing a new
+// one, so repeated calls to WrapStack don't double-capture — but it
+// still wraps err itself (rather than returning the inner StackError),
+// so any context added between err and the inner StackError is never
+// discarded.
 func NewStackError(err error) *StackError {
-	// Limit the stack trace to 16K. Same value used in the errorreporting client,
-	// cloud.google.com/go@v0.66.0/errorreporting/errors.go.
-	var buf [16 * 1024]byte
-	n := runtime.Stack(buf[:], false)
+	if se, ok := err.(*StackError); ok {
+		return se
+	}
+	if se := (*StackError)(nil); errors.As(err, &se) {
+		return &StackError{err: err, pcs: se.pcs}
+	}
+	pcs := make([]uintptr, MaxStackDepth)
+	// Skip runtime.Callers and NewStackError itself.
+	n := runtime.Callers(2, pcs)
 	return &StackError{
-		err:   err,
-		Stack: buf[:n],
+		err: err,
+		pcs: pcs[:n],
 	}
 }
 
@@ -58,3 +88,466 @@ func (e *StackError) Error() string {
 func (e *StackError) Unwrap() error {
 	return e.err
 }
+
+// StackFrames lazily resolves the captured program counters into
+// symbolicated frames. Resolution (file/line/function lookup) happens
+// here rather than at capture time.
+func (e *StackError) StackFrames() []StackFrame {
+	if len(e.pcs) == 0 {
+		return nil
+	}
+	frames := runtime.CallersFrames(e.pcs)
+	var out []StackFrame
+	for {
+		f, more := frames.Next()
+		out = append(out, StackFrame{
+			Function: f.Function,
+			File:     f.File,
+			Line:     f.Line,
+		})
+		if !more {
+			break
+		}
+	}
+	return out
+}
+
+// Format implements fmt.Formatter. %s and %v print the error message as
+// usual; %+v additionally prints a symbolicated stack trace, each frame
+// as its function name followed by a tab-indented file:line, in the
+// style of github.com/pkg/errors.
+func (e *StackError) Format(s fmt.State, verb rune) {
+	switch verb {
+	case 'v':
+		if s.Flag('+') {
+			fmt.Fprint(s, e.Error())
+			for _, f := range e.StackFrames() {
+				fmt.Fprintf(s, "\n%s\n\t%s:%d", f.Function, f.File, f.Line)
+			}
+			return
+		}
+		fmt.Fprint(s, e.Error())
+	case 's':
+		fmt.Fprint(s, e.Error())
+	case 'q':
+		fmt.Fprintf(s, "%q", e.Error())
+	}
+}
+
+// JoinError is the error type returned by Join and JoinStack. It
+// implements Unwrap() []error so errors.Is and errors.As can traverse
+// each joined error independently.
+type JoinError struct {
+	errs []error
+}
+
+// Join returns an error that wraps errs, discarding any nil entries. Its
+// Error method joins the messages of the non-nil errors with newlines,
+// mirroring the standard library's errors.Join. Join returns nil if
+// every element of errs is nil.
+//
+// Unlike errors.Join, Join also captures a stack trace at the call site
+// for each non-nil error that doesn't already carry one (see
+// NewStackError), so the original call sites of the joined errors
+// aren't lost once they're aggregated. NewStackError preserves each
+// error's own context even when it already wraps a stack deeper in its
+// chain, so no joined error's message is ever discarded.
+func Join(errs ...error) error {
+	je := &JoinError{}
+	for _, err := range errs {
+		if err != nil {
+			je.errs = append(je.errs, NewStackError(err))
+		}
+	}
+	if len(je.errs) == 0 {
+		return nil
+	}
+	return je
+}
+
+// JoinStack is like Join, but also ensures the returned error itself
+// carries a stack trace captured at this call site, even when every
+// joined error already has one of its own.
+func JoinStack(errs ...error) error {
+	err := Join(errs...)
+	if err == nil {
+		return nil
+	}
+	// Construct the StackError directly rather than going through
+	// NewStackError: NewStackError's errors.As skip-check would descend
+	// into JoinError's Unwrap() []error branches, match the first joined
+	// error's own StackError, and reuse that error's trace instead of
+	// capturing one at this call site.
+	pcs := make([]uintptr, MaxStackDepth)
+	n := runtime.Callers(2, pcs)
+	return &StackError{err: err, pcs: pcs[:n]}
+}
+
+func (e *JoinError) Error() string {
+	var b strings.Builder
+	for i, err := range e.errs {
+		if i > 0 {
+			b.WriteByte('\n')
+		}
+		b.WriteString(err.Error())
+	}
+	return b.String()
+}
+
+// Errors returns the joined errors.
+func (e *JoinError) Errors() []error {
+	return e.errs
+}
+
+// Unwrap returns the joined errors, so errors.Is and errors.As can walk
+// the tree rooted at each one (requires Go 1.20+).
+func (e *JoinError) Unwrap() []error {
+	return e.errs
+}
+
+// Format implements fmt.Formatter. %+v prints each joined error's
+// message and captured stack trace under its own header.
+func (e *JoinError) Format(s fmt.State, verb rune) {
+	switch verb {
+	case 'v':
+		if s.Flag('+') {
+			for i, err := range e.errs {
+				if i > 0 {
+					fmt.Fprint(s, "\n")
+				}
+				fmt.Fprintf(s, "error %d:\n%+v\n", i, err)
+			}
+			return
+		}
+		fmt.Fprint(s, e.Error())
+	case 's':
+		fmt.Fprint(s, e.Error())
+	}
+}
+
+// Kind categorizes the semantics of a failure (not found, invalid
+// argument, and so on) independent of where in the call stack it
+// occurred, so callers at the edge of a system (an HTTP handler, a gRPC
+// service) can decide how to respond without a type switch over
+// internal error types.
+type Kind int
+
+// The kinds of errors supported by WrapKind and KindOf. Unknown is the
+// zero value, returned by KindOf when err's chain carries no Kind.
+const (
+	Unknown Kind = iota
+	NotFound
+	InvalidArgument
+	PermissionDenied
+	Unauthenticated
+	AlreadyExists
+	ResourceExhausted
+	FailedPrecondition
+	Internal
+	Unavailable
+	DeadlineExceeded
+)
+
+// String returns a human-readable name for k.
+func (k Kind) String() string {
+	switch k {
+	case NotFound:
+		return "not found"
+	case InvalidArgument:
+		return "invalid argument"
+	case PermissionDenied:
+		return "permission denied"
+	case Unauthenticated:
+		return "unauthenticated"
+	case AlreadyExists:
+		return "already exists"
+	case ResourceExhausted:
+		return "resource exhausted"
+	case FailedPrecondition:
+		return "failed precondition"
+	case Internal:
+		return "internal"
+	case Unavailable:
+		return "unavailable"
+	case DeadlineExceeded:
+		return "deadline exceeded"
+	default:
+		return "unknown"
+	}
+}
+
+// Error implements the error interface so a Kind can be used directly as
+// an errors.Is target, e.g. errors.Is(err, derrors.NotFound).
+func (k Kind) Error() string {
+	return k.String()
+}
+
+// kindError tags an error with a Kind.
+type kindError struct {
+	kind Kind
+	err  error
+}
+
+func (e *kindError) Error() string { return e.err.Error() }
+
+func (e *kindError) Unwrap() error { return e.err }
+
+// Is reports whether target is the Kind that tagged e, so that
+// errors.Is(err, derrors.NotFound) succeeds without a hand-written Is
+// method on every error type.
+func (e *kindError) Is(target error) bool {
+	k, ok := target.(Kind)
+	return ok && k == e.kind
+}
+
+// WrapKind is like Wrap, but also tags the error with a Kind, so that
+// KindOf, HTTPStatus, GRPCCode, and errors.Is(err, k) can later recover
+// it.
+func WrapKind(errp *error, k Kind, format string, args ...interface{}) {
+	if *errp != nil {
+		*errp = &kindError{kind: k, err: *errp}
+		Wrap(errp, format, args...)
+	}
+}
+
+// KindOf walks err's chain, including the multiple branches produced by
+// Join, looking for the innermost Kind attached via WrapKind. It
+// returns Unknown if no error in the chain carries one.
+func KindOf(err error) Kind {
+	k := Unknown
+	for err != nil {
+		if ke, ok := err.(*kindError); ok {
+			k = ke.kind
+		}
+		switch x := err.(type) {
+		case interface{ Unwrap() error }:
+			err = x.Unwrap()
+		case interface{ Unwrap() []error }:
+			for _, e := range x.Unwrap() {
+				if ik := KindOf(e); ik != Unknown {
+					k = ik
+				}
+			}
+			return k
+		default:
+			return k
+		}
+	}
+	return k
+}
+
+// HTTPStatus maps the Kind recovered from err's chain to the closest
+// matching HTTP status code, so handlers can translate internal errors
+// to responses without a type switch. It returns
+// http.StatusInternalServerError if err carries no Kind.
+func HTTPStatus(err error) int {
+	switch KindOf(err) {
+	case NotFound:
+		return http.StatusNotFound
+	case InvalidArgument:
+		return http.StatusBadRequest
+	case PermissionDenied:
+		return http.StatusForbidden
+	case Unauthenticated:
+		return http.StatusUnauthorized
+	case AlreadyExists:
+		return http.StatusConflict
+	case ResourceExhausted:
+		return http.StatusTooManyRequests
+	case FailedPrecondition:
+		return http.StatusPreconditionFailed
+	case Unavailable:
+		return http.StatusServiceUnavailable
+	case DeadlineExceeded:
+		return http.StatusGatewayTimeout
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// GRPCCode maps the Kind recovered from err's chain to the numeric value
+// of the matching google.golang.org/grpc/codes.Code, without requiring
+// a dependency on the grpc package. It returns 2 (codes.Unknown) if err
+// carries no Kind.
+func GRPCCode(err error) int {
+	switch KindOf(err) {
+	case InvalidArgument:
+		return 3 // codes.InvalidArgument
+	case DeadlineExceeded:
+		return 4 // codes.DeadlineExceeded
+	case NotFound:
+		return 5 // codes.NotFound
+	case AlreadyExists:
+		return 6 // codes.AlreadyExists
+	case PermissionDenied:
+		return 7 // codes.PermissionDenied
+	case ResourceExhausted:
+		return 8 // codes.ResourceExhausted
+	case FailedPrecondition:
+		return 9 // codes.FailedPrecondition
+	case Unavailable:
+		return 14 // codes.Unavailable
+	case Unauthenticated:
+		return 16 // codes.Unauthenticated
+	case Internal:
+		return 13 // codes.Internal
+	default:
+		return 2 // codes.Unknown
+	}
+}
+
+// valueError attaches a single key/value pair to an error chain, for
+// structured context that should travel with the error to a logger.
+type valueError struct {
+	key   string
+	value any
+	err   error
+}
+
+func (e *valueError) Error() string { return e.err.Error() }
+
+func (e *valueError) Unwrap() error { return e.err }
+
+// LogValue implements slog.LogValuer, so a structured logger given the
+// error directly emits all the key/value context collected via
+// WithValue as a group.
+func (e *valueError) LogValue() slog.Value {
+	vals := Values(e)
+	attrs := make([]slog.Attr, 0, len(vals))
+	for k, v := range vals {
+		attrs = append(attrs, slog.Any(k, v))
+	}
+	return slog.GroupValue(attrs...)
+}
+
+// WithValue attaches key/value to *errp, recoverable later with Values.
+// It's useful for annotating an error with request IDs or other
+// structured context before logging it, without baking that context
+// into the error message itself.
+func WithValue(errp *error, key string, value any) {
+	if *errp != nil {
+		*errp = &valueError{key: key, value: value, err: *errp}
+	}
+}
+
+// Values walks err's wrap chain and merges all key/value pairs attached
+// via WithValue into a single map. When a key was attached more than
+// once, the value closest to err (the most recently attached) wins.
+func Values(err error) map[string]any {
+	vals := map[string]any{}
+	for err != nil {
+		if ve, ok := err.(*valueError); ok {
+			if _, ok := vals[ve.key]; !ok {
+				vals[ve.key] = ve.value
+			}
+		}
+		err = errors.Unwrap(err)
+	}
+	return vals
+}
+
+// userMessageError attaches an end-user-safe message to an error, for
+// translating internal errors into API responses without leaking
+// implementation details.
+type userMessageError struct {
+	msg string
+	err error
+}
+
+func (e *userMessageError) Error() string { return e.err.Error() }
+
+func (e *userMessageError) Unwrap() error { return e.err }
+
+// WithUserMessage attaches msg to *errp as an end-user-safe message,
+// recoverable later with UserMessage, so a caller can report msg to the
+// user while still logging err's full developer-facing Error() text.
+func WithUserMessage(errp *error, msg string) {
+	if *errp != nil {
+		*errp = &userMessageError{msg: msg, err: *errp}
+	}
+}
+
+// UserMessage returns the end-user-safe message attached to err's chain
+// via WithUserMessage, or "" if none was attached.
+func UserMessage(err error) string {
+	for err != nil {
+		if ue, ok := err.(*userMessageError); ok {
+			return ue.msg
+		}
+		err = errors.Unwrap(err)
+	}
+	return ""
+}
+
+// Sentinel is a package-level error value that doubles as both an
+// errors.Is target and a factory for formatted error messages, so
+// callers don't have to hand-write an Is method for every sentinel
+// error. For example:
+//
+//	const ErrNotFound = derrors.Sentinel("resource %s not found")
+//
+//	func lookup(id string) error {
+//		if !exists(id) {
+//			return ErrNotFound.New(id)
+//		}
+//		return nil
+//	}
+//
+//	if errors.Is(err, ErrNotFound) { ... }
+type Sentinel string
+
+// Error implements the error interface, so a Sentinel can be used
+// directly as an errors.Is target.
+func (s Sentinel) Error() string { return string(s) }
+
+// SentinelError is returned by Sentinel.New and Sentinel.Wrap. It
+// formats a message from its Sentinel's format string while preserving
+// the Sentinel's identity for errors.Is comparisons.
+type SentinelError struct {
+	sentinel Sentinel
+	msg      string
+	err      error
+}
+
+func (e *SentinelError) Error() string { return e.msg }
+
+func (e *SentinelError) Unwrap() error { return e.err }
+
+// Is reports whether target is the Sentinel that created e, so that
+// errors.Is(err, ErrNotFound) succeeds even though e's message has been
+// formatted with args.
+func (e *SentinelError) Is(target error) bool {
+	s, ok := target.(Sentinel)
+	return ok && s == e.sentinel
+}
+
+// WithStack attaches a stack trace captured at the call site, e.g.
+// return ErrNotFound.New(id).WithStack().
+func (e *SentinelError) WithStack() error {
+	// Construct the StackError directly rather than going through
+	// NewStackError: its errors.As skip-check would find a StackError
+	// already present in e's cause chain (e.g. after Sentinel.Wrap of an
+	// error that carries one) and reuse its trace, silently dropping the
+	// trace for this call site.
+	pcs := make([]uintptr, MaxStackDepth)
+	n := runtime.Callers(2, pcs)
+	return &StackError{err: e, pcs: pcs[:n]}
+}
+
+// New returns an error formatted from s's format string and args, that
+// still compares equal to s via errors.Is.
+func (s Sentinel) New(args ...any) *SentinelError {
+	return &SentinelError{sentinel: s, msg: fmt.Sprintf(string(s), args...)}
+}
+
+// Wrap is like New, but also records err as the underlying cause,
+// recoverable via errors.Unwrap, and appends err's message to s's. args
+// format s's format string exactly as in New; pass none for a sentinel
+// with no verbs.
+func (s Sentinel) Wrap(err error, args ...any) *SentinelError {
+	return &SentinelError{
+		sentinel: s,
+		msg:      fmt.Sprintf("%s: %s", fmt.Sprintf(string(s), args...), err),
+		err:      err,
+	}
+}